@@ -0,0 +1,43 @@
+package mbserver
+
+import "log"
+
+// Logger is the pluggable logging sink used throughout Server. NewServer installs a
+// default that wraps the standard library log package and never exits the process;
+// callers can supply their own adapter (logrus, zap, slog, ...) with SetLogger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// stdLogger adapts the standard library log package to Logger. It reads s.Debug on
+// every call so toggling Debug after construction takes effect immediately.
+type stdLogger struct {
+	s *Server
+}
+
+// Debugf implements Logger.
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	if l.s.Debug {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
+
+// Infof implements Logger.
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	log.Printf("INFO "+format, args...)
+}
+
+// Errorf implements Logger.
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	log.Printf("ERROR "+format, args...)
+}
+
+// SetLogger replaces s's Logger. Pass nil to restore the default.
+func (s *Server) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = &stdLogger{s: s}
+	}
+	s.logger = logger
+}
@@ -0,0 +1,45 @@
+// Package metrics provides mbserver's metrics sink interface and implementations.
+package metrics
+
+import "time"
+
+// MetricsSink receives counters and histograms from an mbserver.Server. Implementations
+// must be safe for concurrent use, since the Server dispatches requests from one
+// goroutine but TCP/RTU transports may report bytes and connection counts from others.
+type MetricsSink interface {
+	// IncRequest counts one request handled for functionCode/unitID over transport
+	// ("tcp", "rtu" or "tls").
+	IncRequest(functionCode, unitID uint8, transport string)
+	// IncException counts one exception response returned for exceptionCode.
+	IncException(exceptionCode uint8)
+	// ObserveLatency records how long functionCode took to handle over transport.
+	ObserveLatency(functionCode uint8, transport string, d time.Duration)
+	// AddBytesRead counts n bytes read from transport.
+	AddBytesRead(transport string, n int)
+	// AddBytesWritten counts n bytes written to transport.
+	AddBytesWritten(transport string, n int)
+	// SetOpenConnections reports the current number of open connections on transport.
+	SetOpenConnections(transport string, n int)
+}
+
+// Noop discards every observation. It is the default MetricsSink, so instrumenting a
+// Server costs nothing until a real sink is wired in with Server.Metrics.
+type Noop struct{}
+
+// IncRequest implements MetricsSink.
+func (Noop) IncRequest(uint8, uint8, string) {}
+
+// IncException implements MetricsSink.
+func (Noop) IncException(uint8) {}
+
+// ObserveLatency implements MetricsSink.
+func (Noop) ObserveLatency(uint8, string, time.Duration) {}
+
+// AddBytesRead implements MetricsSink.
+func (Noop) AddBytesRead(string, int) {}
+
+// AddBytesWritten implements MetricsSink.
+func (Noop) AddBytesWritten(string, int) {}
+
+// SetOpenConnections implements MetricsSink.
+func (Noop) SetOpenConnections(string, int) {}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Prometheus is a MetricsSink backed by a prometheus.Registerer.
+type Prometheus struct {
+	requestsTotal   *prometheus.CounterVec
+	exceptionsTotal *prometheus.CounterVec
+	latency         *prometheus.HistogramVec
+	bytesRead       *prometheus.CounterVec
+	bytesWritten    *prometheus.CounterVec
+	openConnections *prometheus.GaugeVec
+}
+
+// NewPrometheus registers mbserver's metrics with reg and returns a MetricsSink
+// backed by them.
+func NewPrometheus(reg prometheus.Registerer) *Prometheus {
+	p := &Prometheus{
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mbserver",
+			Name:      "requests_total",
+			Help:      "Modbus requests handled, by function code, unit ID and transport.",
+		}, []string{"function", "unit", "transport"}),
+		exceptionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mbserver",
+			Name:      "exceptions_total",
+			Help:      "Modbus exception responses returned, by exception code.",
+		}, []string{"exception"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "mbserver",
+			Name:      "handler_latency_seconds",
+			Help:      "Handler latency in seconds, by function code and transport.",
+		}, []string{"function", "transport"}),
+		bytesRead: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mbserver",
+			Name:      "bytes_read_total",
+			Help:      "Bytes read, by transport.",
+		}, []string{"transport"}),
+		bytesWritten: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mbserver",
+			Name:      "bytes_written_total",
+			Help:      "Bytes written, by transport.",
+		}, []string{"transport"}),
+		openConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "mbserver",
+			Name:      "open_connections",
+			Help:      "Currently open connections, by transport.",
+		}, []string{"transport"}),
+	}
+
+	reg.MustRegister(p.requestsTotal, p.exceptionsTotal, p.latency, p.bytesRead, p.bytesWritten, p.openConnections)
+	return p
+}
+
+// IncRequest implements MetricsSink.
+func (p *Prometheus) IncRequest(functionCode, unitID uint8, transport string) {
+	p.requestsTotal.WithLabelValues(strconv.Itoa(int(functionCode)), strconv.Itoa(int(unitID)), transport).Inc()
+}
+
+// IncException implements MetricsSink.
+func (p *Prometheus) IncException(exceptionCode uint8) {
+	p.exceptionsTotal.WithLabelValues(strconv.Itoa(int(exceptionCode))).Inc()
+}
+
+// ObserveLatency implements MetricsSink.
+func (p *Prometheus) ObserveLatency(functionCode uint8, transport string, d time.Duration) {
+	p.latency.WithLabelValues(strconv.Itoa(int(functionCode)), transport).Observe(d.Seconds())
+}
+
+// AddBytesRead implements MetricsSink.
+func (p *Prometheus) AddBytesRead(transport string, n int) {
+	p.bytesRead.WithLabelValues(transport).Add(float64(n))
+}
+
+// AddBytesWritten implements MetricsSink.
+func (p *Prometheus) AddBytesWritten(transport string, n int) {
+	p.bytesWritten.WithLabelValues(transport).Add(float64(n))
+}
+
+// SetOpenConnections implements MetricsSink.
+func (p *Prometheus) SetOpenConnections(transport string, n int) {
+	p.openConnections.WithLabelValues(transport).Set(float64(n))
+}
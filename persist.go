@@ -0,0 +1,582 @@
+package mbserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName        = "modbus.wal"
+	snapshotFilePrefix = "modbus.snap."
+)
+
+// persistedFunctions are the write function codes whose successful invocations are
+// appended to the WAL.
+var persistedFunctions = map[uint8]bool{5: true, 6: true, 15: true, 16: true}
+
+// StateObject is a point-in-time copy of one slave's memory maps, as written to a
+// snapshot file.
+type StateObject struct {
+	DiscreteInputs   []byte
+	Coils            []byte
+	HoldingRegisters []uint16
+	InputRegisters   []uint16
+}
+
+// PersistOptions controls when a Server snapshots its memory maps and truncates the
+// write-ahead log.
+type PersistOptions struct {
+	// SnapshotEvery snapshots after this many WAL records have been appended since
+	// the last snapshot. Zero disables the write-count trigger.
+	SnapshotEvery int
+	// SnapshotInterval snapshots after this much time has elapsed since the last
+	// snapshot. Zero disables the time trigger.
+	SnapshotInterval time.Duration
+}
+
+// DefaultPersistOptions is used by SetPersistence when called with a zero PersistOptions.
+var DefaultPersistOptions = PersistOptions{
+	SnapshotEvery:    1000,
+	SnapshotInterval: 30 * time.Second,
+}
+
+// SetPersistence enables write-ahead-log-backed persistence rooted at dir, replacing
+// any persistence previously configured on s. It replays the newest valid snapshot
+// plus any WAL records written after it before returning, so s.slaves reflects the
+// last durable state. Persistence is disabled until this is called; call it with an
+// empty dir's worth of files to start fresh.
+func (s *Server) SetPersistence(dir string, opts PersistOptions) error {
+	s.persistMu.Lock()
+	if s.persist != nil {
+		s.persist.close()
+		s.persist = nil
+	}
+	s.persistMu.Unlock()
+
+	if opts == (PersistOptions{}) {
+		opts = DefaultPersistOptions
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	p := &persistence{server: s, dir: dir, opts: opts, stop: make(chan struct{})}
+	if err := p.restore(); err != nil {
+		return err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.wal = wal
+	p.walWriter = bufio.NewWriter(wal)
+
+	s.persistMu.Lock()
+	s.persist = p
+	s.persistMu.Unlock()
+	if opts.SnapshotInterval > 0 {
+		go p.snapshotLoop()
+	}
+	return nil
+}
+
+// Checkpoint forces an immediate snapshot of every slave's memory maps and truncates
+// the WAL. It is a no-op if persistence is not configured.
+func (s *Server) Checkpoint() error {
+	s.persistMu.RLock()
+	p := s.persist
+	s.persistMu.RUnlock()
+	if p == nil {
+		return nil
+	}
+	return p.snapshot()
+}
+
+// persistence owns the WAL and snapshot files backing a Server's checkpointed state.
+type persistence struct {
+	server *Server
+	dir    string
+	opts   PersistOptions
+
+	mu            sync.Mutex
+	wal           *os.File
+	walWriter     *bufio.Writer
+	seq           uint64
+	sinceSnapshot int
+	stop          chan struct{}
+
+	// snapshotMu serializes whole snapshot attempts: the SnapshotEvery-triggered
+	// goroutine and the SnapshotInterval ticker must never run the write-snapshot +
+	// compact-WAL sequence concurrently, or one's WAL compaction can race the other's.
+	snapshotMu sync.Mutex
+}
+
+func (p *persistence) close() {
+	close(p.stop)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.wal != nil {
+		p.wal.Close()
+	}
+}
+
+// append records a successful write-function invocation to the WAL, triggering a
+// background snapshot if SnapshotEvery is configured and reached.
+func (p *persistence) append(unitID, function uint8, address, quantity uint16, payload []byte) error {
+	p.mu.Lock()
+	p.seq++
+	rec := &walRecord{Seq: p.seq, UnitID: unitID, Function: function, Address: address, Quantity: quantity, Payload: payload}
+	_, err := p.walWriter.Write(rec.encode())
+	if err == nil {
+		err = p.walWriter.Flush()
+	}
+	if err == nil {
+		p.sinceSnapshot++
+	}
+	trigger := err == nil && p.opts.SnapshotEvery > 0 && p.sinceSnapshot >= p.opts.SnapshotEvery
+	p.mu.Unlock()
+
+	if trigger {
+		go func() {
+			if err := p.snapshot(); err != nil {
+				p.server.logger.Errorf("mbserver: snapshot after %d writes failed: %v", p.opts.SnapshotEvery, err)
+			}
+		}()
+	}
+	return err
+}
+
+// snapshot writes a fresh, checksummed snapshot of every slave and compacts the WAL
+// down to the records appended after the sequence number it covers. snapshotMu
+// serializes whole attempts, so a SnapshotEvery-triggered snapshot and a
+// SnapshotInterval-triggered one can never interleave their WAL compactions.
+func (p *persistence) snapshot() error {
+	p.snapshotMu.Lock()
+	defer p.snapshotMu.Unlock()
+
+	p.mu.Lock()
+	seq := p.seq
+	p.mu.Unlock()
+
+	p.server.memMu.RLock()
+	slaves := copySlaves(p.server.slaves)
+	p.server.memMu.RUnlock()
+
+	if err := writeSnapshot(p.dir, seq, slaves); err != nil {
+		return err
+	}
+
+	return p.compactWAL(seq)
+}
+
+// copySlaves deep-copies every slave's memory maps so a snapshot can be written without
+// holding server.memMu for the duration of the (potentially slow) disk I/O.
+func copySlaves(slaves map[uint8]*Slave) map[uint8]StateObject {
+	out := make(map[uint8]StateObject, len(slaves))
+	for unitID, sl := range slaves {
+		out[unitID] = StateObject{
+			DiscreteInputs:   append([]byte(nil), sl.DiscreteInputs...),
+			Coils:            append([]byte(nil), sl.Coils...),
+			HoldingRegisters: append([]uint16(nil), sl.HoldingRegisters...),
+			InputRegisters:   append([]uint16(nil), sl.InputRegisters...),
+		}
+	}
+	return out
+}
+
+// compactWAL rewrites the WAL to keep only records with Seq greater than seq, the
+// sequence number already covered by a just-written snapshot. Re-reading the live WAL
+// under p.mu, rather than truncating it outright, preserves records that append added
+// while the snapshot's disk I/O was in flight.
+func (p *persistence) compactWAL(seq uint64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.walWriter.Flush(); err != nil {
+		return err
+	}
+	if _, err := p.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var kept []*walRecord
+	r := bufio.NewReader(p.wal)
+	for {
+		rec, err := decodeWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.server.logger.Errorf("mbserver: discarding torn WAL tail during compaction: %v", err)
+			break
+		}
+		if rec.Seq > seq {
+			kept = append(kept, rec)
+		}
+	}
+
+	tmpName := filepath.Join(p.dir, walFileName+".tmp")
+	tmp, err := os.OpenFile(tmpName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for _, rec := range kept {
+		if _, err := tmp.Write(rec.encode()); err != nil {
+			tmp.Close()
+			os.Remove(tmpName)
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	if err := p.wal.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(p.dir, walFileName)); err != nil {
+		return err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(p.dir, walFileName), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.wal = wal
+	p.walWriter = bufio.NewWriter(wal)
+	p.sinceSnapshot = len(kept)
+	return nil
+}
+
+func (p *persistence) snapshotLoop() {
+	ticker := time.NewTicker(p.opts.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.snapshot(); err != nil {
+				p.server.logger.Errorf("mbserver: periodic snapshot failed: %v", err)
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// restore loads the newest valid snapshot, if any, into p.server.slaves, then replays
+// any WAL records with a higher sequence number.
+func (p *persistence) restore() error {
+	snap, _, err := latestSnapshot(p.dir, p.server.logger)
+	if err != nil {
+		return err
+	}
+
+	seq := uint64(0)
+	if snap != nil {
+		seq = snap.Seq
+
+		// memMu also guards the slaves map (see server.go), since SetPersistence can
+		// be called after a listener is already dispatching requests on s.handle.
+		p.server.memMu.Lock()
+		if p.server.slaves == nil {
+			p.server.slaves = make(map[uint8]*Slave)
+		}
+		for unitID, so := range snap.Slaves {
+			sl := newSlave(unitID)
+			sl.DiscreteInputs = so.DiscreteInputs
+			sl.Coils = so.Coils
+			sl.HoldingRegisters = so.HoldingRegisters
+			sl.InputRegisters = so.InputRegisters
+			p.server.slaves[unitID] = sl
+
+			// Unit 0 is also reachable through the Server's own fields (see
+			// server.go), so a restored unit 0 has to be pointed at from there too,
+			// the same way NewServer keeps them in sync at construction.
+			if unitID == 0 {
+				p.server.DiscreteInputs = sl.DiscreteInputs
+				p.server.Coils = sl.Coils
+				p.server.HoldingRegisters = sl.HoldingRegisters
+				p.server.InputRegisters = sl.InputRegisters
+				p.server.function = sl.function
+			}
+		}
+		p.server.memMu.Unlock()
+	}
+
+	f, err := os.Open(filepath.Join(p.dir, walFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			p.mu.Lock()
+			p.seq = seq
+			p.mu.Unlock()
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		rec, err := decodeWALRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.server.logger.Errorf("mbserver: discarding torn WAL tail: %v", err)
+			break
+		}
+		if rec.Seq <= seq {
+			continue
+		}
+		applyWALRecord(p.server, rec)
+		seq = rec.Seq
+	}
+	p.mu.Lock()
+	p.seq = seq
+	p.mu.Unlock()
+	return nil
+}
+
+// walRecord is one successful write-function invocation appended to the WAL.
+type walRecord struct {
+	Seq      uint64
+	UnitID   uint8
+	Function uint8
+	Address  uint16
+	Quantity uint16
+	Payload  []byte
+}
+
+// encode frames the record as length-prefixed body plus trailing CRC32, so a torn
+// write at the tail of the file can be detected and discarded on restore.
+func (r *walRecord) encode() []byte {
+	body := make([]byte, 16+len(r.Payload))
+	binary.BigEndian.PutUint64(body[0:8], r.Seq)
+	body[8] = r.UnitID
+	body[9] = r.Function
+	binary.BigEndian.PutUint16(body[10:12], r.Address)
+	binary.BigEndian.PutUint16(body[12:14], r.Quantity)
+	binary.BigEndian.PutUint16(body[14:16], uint16(len(r.Payload)))
+	copy(body[16:], r.Payload)
+
+	frame := make([]byte, 4+len(body)+4)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(body)))
+	copy(frame[4:], body)
+	binary.BigEndian.PutUint32(frame[4+len(body):], crc32.ChecksumIEEE(body))
+	return frame
+}
+
+func decodeWALRecord(r *bufio.Reader) (*walRecord, error) {
+	var lengthBytes [4]byte
+	if _, err := io.ReadFull(r, lengthBytes[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBytes[:])
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var crcBytes [4]byte
+	if _, err := io.ReadFull(r, crcBytes[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if binary.BigEndian.Uint32(crcBytes[:]) != crc32.ChecksumIEEE(body) {
+		return nil, fmt.Errorf("mbserver: WAL record checksum mismatch")
+	}
+	if len(body) < 16 {
+		return nil, fmt.Errorf("mbserver: WAL record too short")
+	}
+	payloadLen := binary.BigEndian.Uint16(body[14:16])
+	if int(16+payloadLen) != len(body) {
+		return nil, fmt.Errorf("mbserver: WAL record payload length mismatch")
+	}
+
+	return &walRecord{
+		Seq:      binary.BigEndian.Uint64(body[0:8]),
+		UnitID:   body[8],
+		Function: body[9],
+		Address:  binary.BigEndian.Uint16(body[10:12]),
+		Quantity: binary.BigEndian.Uint16(body[12:14]),
+		Payload:  append([]byte(nil), body[16:]...),
+	}, nil
+}
+
+// decodeWriteRequest extracts the starting address, quantity and raw payload a WAL
+// record needs to replay function's request data.
+func decodeWriteRequest(function uint8, data []byte) (address, quantity uint16, payload []byte) {
+	address = binary.BigEndian.Uint16(data[0:2])
+	switch function {
+	case 5, 6:
+		return address, 1, data[2:4]
+	default: // 15, 16
+		quantity = binary.BigEndian.Uint16(data[2:4])
+		return address, quantity, data[5:]
+	}
+}
+
+// applyWALRecord reapplies a WAL-recorded write directly to the target slave's
+// memory. The write already validated and succeeded by the time it was committed to
+// the WAL, so no further validation is needed here. The mutation runs under memMu,
+// the same lock snapshot's copySlaves reads slave memory under, so a restore()
+// running while a snapshot is in flight can't race it.
+func applyWALRecord(s *Server, rec *walRecord) {
+	sl := s.Slave(rec.UnitID)
+
+	s.memMu.Lock()
+	defer s.memMu.Unlock()
+
+	switch rec.Function {
+	case 5: // write single coil
+		if rec.Payload[0] == 0xFF {
+			sl.Coils[rec.Address] = 1
+		} else {
+			sl.Coils[rec.Address] = 0
+		}
+	case 6: // write single holding register
+		sl.HoldingRegisters[rec.Address] = binary.BigEndian.Uint16(rec.Payload)
+	case 15: // write multiple coils
+		for i := 0; i < int(rec.Quantity); i++ {
+			if rec.Payload[i/8]&(1<<uint(i%8)) != 0 {
+				sl.Coils[int(rec.Address)+i] = 1
+			} else {
+				sl.Coils[int(rec.Address)+i] = 0
+			}
+		}
+	case 16: // write multiple holding registers
+		for i := 0; i < int(rec.Quantity); i++ {
+			sl.HoldingRegisters[int(rec.Address)+i] = binary.BigEndian.Uint16(rec.Payload[i*2:])
+		}
+	}
+}
+
+// snapshotFile is the gob-encoded body of a snapshot: every slave's memory, as of Seq
+// WAL records applied.
+type snapshotFile struct {
+	Seq    uint64
+	Slaves map[uint8]StateObject
+}
+
+// writeSnapshot atomically writes a length-prefixed, checksummed, gob-encoded
+// snapshotFile to dir, via a temp file that is fsynced then renamed into place so a
+// crash mid-write can never leave a torn snapshot visible to restore.
+func writeSnapshot(dir string, seq uint64, slaves map[uint8]StateObject) (err error) {
+	snap := snapshotFile{Seq: seq, Slaves: slaves}
+
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(snap); err != nil {
+		return err
+	}
+
+	name := filepath.Join(dir, fmt.Sprintf("%s%020d", snapshotFilePrefix, seq))
+	tmp := name + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(body.Len()))
+	if _, err = f.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err = f.Write(body.Bytes()); err != nil {
+		return err
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(body.Bytes()))
+	if _, err = f.Write(crc[:]); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func readSnapshot(name string) (*snapshotFile, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("mbserver: truncated snapshot %s", name)
+	}
+	length := binary.BigEndian.Uint32(data[0:4])
+	if uint32(len(data)) < 4+length+4 {
+		return nil, fmt.Errorf("mbserver: torn snapshot %s", name)
+	}
+	body := data[4 : 4+length]
+	crc := binary.BigEndian.Uint32(data[4+length : 4+length+4])
+	if crc32.ChecksumIEEE(body) != crc {
+		return nil, fmt.Errorf("mbserver: snapshot checksum mismatch in %s", name)
+	}
+
+	var snap snapshotFile
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// latestSnapshot returns the newest snapshot in dir that passes its checksum,
+// discarding any corrupt or torn ones it encounters along the way.
+func latestSnapshot(dir string, logger Logger) (*snapshotFile, string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), snapshotFilePrefix) && !strings.HasSuffix(entry.Name(), ".tmp") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i := len(names) - 1; i >= 0; i-- {
+		name := filepath.Join(dir, names[i])
+		snap, err := readSnapshot(name)
+		if err != nil {
+			logger.Errorf("mbserver: discarding corrupt snapshot %s: %v", name, err)
+			continue
+		}
+		return snap, name, nil
+	}
+	return nil, "", nil
+}
@@ -0,0 +1,330 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+// Upstream is a Modbus device that a Server forwards requests to when
+// acting as a gateway. Implementations must serialize their own wire access so that
+// concurrent callers never interleave bytes on the same connection or serial port.
+type Upstream interface {
+	// Do forwards a request for unitID/function/data to the upstream device and
+	// returns its response data, or the Exception the upstream device responded with.
+	Do(unitID uint8, function uint8, data []byte) ([]byte, *Exception, error)
+
+	// Close releases the upstream's connection or serial port.
+	Close() error
+}
+
+// ProxyRoute configures how a Server.ProxyTo gateway handles requests for one unit ID.
+type ProxyRoute struct {
+	// Local, when true, serves this unit from the Server's own memory maps instead of
+	// forwarding it upstream.
+	Local bool
+	// RemapUnitID, when non-zero, overrides the unit ID presented to the upstream
+	// device. Zero leaves the incoming unit ID unchanged.
+	RemapUnitID uint8
+}
+
+// ProxyTo configures the Server to forward requests to upstream. Units without an
+// explicit RouteUnit entry are forwarded upstream unchanged; RouteUnit can mark
+// specific units as Local so a single TCP endpoint can front a mixed RTU bus plus a
+// local virtual slave.
+func (s *Server) ProxyTo(upstream Upstream) {
+	s.upstream = upstream
+	if s.proxyTimeout == 0 {
+		s.proxyTimeout = time.Second
+	}
+}
+
+// RouteUnit registers how unitID is handled once ProxyTo is in effect.
+func (s *Server) RouteUnit(unitID uint8, route ProxyRoute) {
+	if s.proxyRoutes == nil {
+		s.proxyRoutes = make(map[uint8]ProxyRoute)
+	}
+	s.proxyRoutes[unitID] = route
+}
+
+// SetProxyTimeout bounds how long a forwarded request waits for the upstream to
+// respond before failing with GatewayTargetDeviceFailedToRespond. ProxyTo sets it to
+// one second if it is still unset.
+//
+// timeout only abandons proxy's wait; it does not cancel the in-flight
+// Upstream.Do call, which keeps running (and keeps holding the upstream's own
+// serialization lock) until the upstream's own TCPUpstream.Timeout/RTUUpstream.Timeout
+// elapses. Set timeout >= the upstream's configured Timeout, or a single slow or
+// hung upstream call will queue up every subsequent proxied request behind it for as
+// long as the upstream's own timeout takes to fire.
+func (s *Server) SetProxyTimeout(timeout time.Duration) {
+	s.proxyTimeout = timeout
+}
+
+// proxy forwards request to s.upstream if unitID is not routed Local, returning the
+// response frame to send downstream and the Exception it carries (&Success if none).
+// It returns a nil Framer when the request should instead be served from the Server's
+// own memory maps.
+//
+// The s.proxyTimeout wait below only abandons this call's own wait for the result; the
+// goroutine invoking Upstream.Do keeps running until Do itself returns, see
+// SetProxyTimeout's doc comment for why s.proxyTimeout must be kept >= the upstream's
+// own Timeout.
+func (s *Server) proxy(request *Request, unitID uint8) (Framer, *Exception) {
+	if route, ok := s.proxyRoutes[unitID]; ok && route.Local {
+		return nil, nil
+	}
+
+	remoteUnit := unitID
+	if route, ok := s.proxyRoutes[unitID]; ok && route.RemapUnitID != 0 {
+		remoteUnit = route.RemapUnitID
+	}
+
+	response := request.frame.Copy()
+
+	type result struct {
+		data      []byte
+		exception *Exception
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		data, exception, err := s.upstream.Do(remoteUnit, request.frame.GetFunction(), request.frame.GetData())
+		done <- result{data, exception, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			s.logger.Errorf("mbserver: upstream error: %v", r.err)
+			response.SetException(&GatewayTargetDeviceFailedToRespond)
+			return response, &GatewayTargetDeviceFailedToRespond
+		}
+		if r.exception != nil && *r.exception != Success {
+			response.SetException(r.exception)
+			return response, r.exception
+		}
+		response.SetData(r.data)
+		return response, &Success
+	case <-time.After(s.proxyTimeout):
+		response.SetException(&GatewayTargetDeviceFailedToRespond)
+		return response, &GatewayTargetDeviceFailedToRespond
+	}
+}
+
+// TCPUpstream forwards requests to a Modbus TCP device, serializing access to the
+// connection with a mutex so concurrent downstream clients don't interleave bytes on
+// the wire.
+type TCPUpstream struct {
+	Addr string
+	// Timeout bounds dialing and each Do call's connect/write/read. A hung call
+	// keeps holding mu until Timeout elapses, so a Server proxying to this upstream
+	// should set its own proxyTimeout (SetProxyTimeout) to at least this value.
+	Timeout time.Duration
+
+	mu            sync.Mutex
+	conn          net.Conn
+	transactionID uint16
+}
+
+// Do implements Upstream.
+func (u *TCPUpstream) Do(unitID uint8, function uint8, data []byte) ([]byte, *Exception, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.connect(); err != nil {
+		return nil, nil, err
+	}
+
+	u.transactionID++
+	adu := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(adu[0:2], u.transactionID)
+	binary.BigEndian.PutUint16(adu[2:4], 0)
+	binary.BigEndian.PutUint16(adu[4:6], uint16(2+len(data)))
+	adu[6] = unitID
+	adu[7] = function
+	copy(adu[8:], data)
+
+	u.conn.SetDeadline(time.Now().Add(u.timeout()))
+	if _, err := u.conn.Write(adu); err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, nil, err
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(u.conn, header); err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:6])
+	if length < 2 {
+		return nil, nil, fmt.Errorf("mbserver: short upstream TCP response")
+	}
+	payload := make([]byte, length-2)
+	if _, err := io.ReadFull(u.conn, payload); err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return nil, nil, err
+	}
+
+	return parseUpstreamPDU(header[7], payload)
+}
+
+func (u *TCPUpstream) connect() error {
+	if u.conn != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", u.Addr, u.timeout())
+	if err != nil {
+		return err
+	}
+	u.conn = conn
+	return nil
+}
+
+func (u *TCPUpstream) timeout() time.Duration {
+	if u.Timeout == 0 {
+		return time.Second
+	}
+	return u.Timeout
+}
+
+// Close implements Upstream.
+func (u *TCPUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Close()
+	u.conn = nil
+	return err
+}
+
+// RTUUpstream forwards requests to a Modbus RTU device over a single serial port,
+// serializing access with a mutex so concurrent downstream clients don't interleave
+// bytes on the wire.
+type RTUUpstream struct {
+	Config serial.Config
+	// Timeout is the serial port's read timeout, applied when the port is opened and
+	// only if Config.Timeout is zero; a non-zero Config.Timeout is used instead. A hung call
+	// keeps holding mu until Timeout elapses, so a Server proxying to this upstream
+	// should set its own proxyTimeout (SetProxyTimeout) to at least this value.
+	Timeout time.Duration
+
+	mu   sync.Mutex
+	port serial.Port
+}
+
+// Do implements Upstream.
+func (u *RTUUpstream) Do(unitID uint8, function uint8, data []byte) ([]byte, *Exception, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err := u.connect(); err != nil {
+		return nil, nil, err
+	}
+
+	adu := make([]byte, 2+len(data)+2)
+	adu[0] = unitID
+	adu[1] = function
+	copy(adu[2:], data)
+	crc := crcModbus(adu[:2+len(data)])
+	adu[len(adu)-2] = byte(crc)
+	adu[len(adu)-1] = byte(crc >> 8)
+
+	if _, err := u.port.Write(adu); err != nil {
+		u.port.Close()
+		u.port = nil
+		return nil, nil, err
+	}
+
+	response := make([]byte, 256)
+	n, err := u.port.Read(response)
+	if err != nil {
+		u.port.Close()
+		u.port = nil
+		return nil, nil, err
+	}
+	if n < 4 {
+		return nil, nil, fmt.Errorf("mbserver: short upstream RTU response")
+	}
+	response = response[:n]
+	if crcModbus(response[:len(response)-2]) != binary.LittleEndian.Uint16(response[len(response)-2:]) {
+		return nil, nil, fmt.Errorf("mbserver: upstream RTU response failed CRC check")
+	}
+
+	return parseUpstreamPDU(response[1], response[2:len(response)-2])
+}
+
+func (u *RTUUpstream) connect() error {
+	if u.port != nil {
+		return nil
+	}
+	cfg := u.Config
+	if cfg.Timeout == 0 {
+		cfg.Timeout = u.timeout()
+	}
+	port, err := serial.Open(&cfg)
+	if err != nil {
+		return err
+	}
+	u.port = port
+	return nil
+}
+
+func (u *RTUUpstream) timeout() time.Duration {
+	if u.Timeout == 0 {
+		return time.Second
+	}
+	return u.Timeout
+}
+
+// Close implements Upstream.
+func (u *RTUUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.port == nil {
+		return nil
+	}
+	err := u.port.Close()
+	u.port = nil
+	return err
+}
+
+// parseUpstreamPDU splits an upstream's response PDU into its data and, if the
+// function code's high bit is set, the Exception it carries.
+func parseUpstreamPDU(function uint8, data []byte) ([]byte, *Exception, error) {
+	if function&0x80 != 0 {
+		if len(data) == 0 {
+			return nil, nil, fmt.Errorf("mbserver: upstream exception response missing exception code")
+		}
+		exception := Exception(data[0])
+		return nil, &exception, nil
+	}
+	return data, nil, nil
+}
+
+// crcModbus computes the Modbus RTU CRC16 over data.
+func crcModbus(data []byte) uint16 {
+	var crc uint16 = 0xFFFF
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc >>= 1
+				crc ^= 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,90 @@
+package mbserver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreamPDU(t *testing.T) {
+	data, exception, err := parseUpstreamPDU(0x10, []byte{0x00, 0x6b, 0x00, 0x03})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exception != nil {
+		t.Fatalf("unexpected exception: %v", *exception)
+	}
+	if len(data) != 4 {
+		t.Fatalf("expected 4 data bytes, got %d", len(data))
+	}
+
+	_, exception, err = parseUpstreamPDU(0x90, []byte{0x02})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exception == nil || *exception != Exception(0x02) {
+		t.Fatalf("expected exception 0x02, got %v", exception)
+	}
+
+	if _, _, err := parseUpstreamPDU(0x90, nil); err == nil {
+		t.Fatal("expected error for exception response missing exception code")
+	}
+}
+
+// TestTCPUpstreamDoUsesHeaderFunction verifies that Do reads the function code from the
+// MBAP header rather than the first byte of the PDU data, so write-response echoes
+// (e.g. FC16's address/quantity echo) aren't truncated and read-response byte counts
+// >=128 aren't misread as an exception marker.
+func TestTCPUpstreamDoUsesHeaderFunction(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint16(header[4:6])
+		request := make([]byte, length-2)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+
+		// Echo back a FC16 write response whose data starts with a byte that has the
+		// high bit set (0x80), which the old payload[0]-based parsing would have
+		// mistaken for an exception marker.
+		resp := make([]byte, 8+4)
+		copy(resp[0:2], header[0:2])
+		binary.BigEndian.PutUint16(resp[4:6], uint16(2+4))
+		resp[6] = header[6]
+		resp[7] = header[7]
+		binary.BigEndian.PutUint16(resp[8:10], 0x8001)
+		binary.BigEndian.PutUint16(resp[10:12], 1)
+		conn.Write(resp)
+	}()
+
+	u := &TCPUpstream{Addr: listener.Addr().String(), Timeout: time.Second}
+	defer u.Close()
+
+	data, exception, err := u.Do(1, 16, []byte{0x80, 0x01, 0x00, 0x01})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exception != nil {
+		t.Fatalf("unexpected exception: %v", *exception)
+	}
+	if len(data) != 4 || data[0] != 0x80 || data[1] != 0x01 {
+		t.Fatalf("expected full 4-byte echo starting with 0x80 0x01, got %x", data)
+	}
+}
@@ -2,39 +2,80 @@
 package mbserver
 
 import (
-	"bytes"
-	"encoding/gob"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
-	"os"
+	"sync"
+	"time"
 
+	"github.com/brian-rcoffee/mbserver/metrics"
 	"github.com/goburrow/serial"
 )
 
-const (
-	checkpointFile = "modbus.state"
-)
-
 // Server is a Modbus slave with allocated memory for discrete inputs, coils, etc.
 type Server struct {
 	// Debug enables more verbose messaging.
-	Debug            bool
-	listeners        []net.Listener
-	ports            []serial.Port
-	requestChan      chan *Request
-	function         [256](func(*Server, Framer) ([]byte, *Exception))
+	Debug       bool
+	listeners   []net.Listener
+	ports       []serial.Port
+	requestChan chan *Request
+	function    [256](func(*Server, Framer) ([]byte, *Exception))
+
+	// DiscreteInputs, Coils, HoldingRegisters and InputRegisters back unit 0's memory.
+	// Direct access to these fields (srv.Coils[x] = 1) is only meaningful while a
+	// single unit is in use: once a second unit is registered via Slave, handle
+	// rebinds these fields (under memMu) to whichever unit it is currently
+	// dispatching to, so a caller reading them directly afterwards sees "whichever
+	// unit handled the last request", not "unit 0". Prefer Server.Slave(unitID) for
+	// direct memory access once multiple units are in play.
 	DiscreteInputs   []byte
 	Coils            []byte
 	HoldingRegisters []uint16
 	InputRegisters   []uint16
+
+	// upstream, when set with ProxyTo, receives requests that are not routed to a
+	// local unit by proxyRoutes.
+	upstream     Upstream
+	proxyRoutes  map[uint8]ProxyRoute
+	proxyTimeout time.Duration
+
+	// slaves holds the per-unit-ID memory maps and function-handler tables. slave 0
+	// is always present, backed by the Server's own DiscreteInputs/Coils/... fields
+	// and function table, so existing single-slave callers keep working unchanged.
+	slaves map[uint8]*Slave
+
+	// memMu guards slave memory (DiscreteInputs/Coils/HoldingRegisters/InputRegisters,
+	// and the equivalent fields on each *Slave) and the slaves map itself against
+	// concurrent readers such as persistence's background snapshot goroutines and
+	// restore(), which can run while a listener is already dispatching requests.
+	// handle holds the write lock only around the function handler invocation that
+	// mutates this unit's memory; readers should hold the read lock while copying it.
+	memMu sync.RWMutex
+
+	// persistMu guards the persist field itself against concurrent readers: handle
+	// reads it on every write request, while SetPersistence and Checkpoint can
+	// replace or close it from another goroutine at any time, including while a
+	// listener is already dispatching requests.
+	persistMu sync.RWMutex
+
+	// persist, set by SetPersistence, WAL-logs successful writes and periodically
+	// snapshots every slave's memory maps. Persistence is disabled by default. Access
+	// it only under persistMu.
+	persist *persistence
+
+	// Metrics receives request/exception counters and latency histograms. Nil (the
+	// default) costs nothing; set it to wire up a real metrics.MetricsSink such as
+	// metrics.NewPrometheus.
+	Metrics metrics.MetricsSink
+
+	logger Logger
 }
 
-// Request contains the connection and Modbus frame.
+// Request contains the connection, the transport it arrived over (for metrics labels;
+// empty lets transportLabel infer it from the frame type), and the Modbus frame.
 type Request struct {
-	conn  io.ReadWriteCloser
-	frame Framer
+	conn      io.ReadWriteCloser
+	transport string
+	frame     Framer
 }
 
 // NewServer creates a new Modbus server (slave).
@@ -57,8 +98,20 @@ func NewServer() *Server {
 	s.function[15] = WriteMultipleCoils
 	s.function[16] = WriteHoldingRegisters
 
-	// attempt to restore state
-	s.restoreState()
+	// Register unit 0 as the default slave, backed by the Server's own memory maps
+	// and function table.
+	s.slaves = map[uint8]*Slave{
+		0: {
+			unitID:           0,
+			DiscreteInputs:   s.DiscreteInputs,
+			Coils:            s.Coils,
+			HoldingRegisters: s.HoldingRegisters,
+			InputRegisters:   s.InputRegisters,
+			function:         s.function,
+		},
+	}
+
+	s.logger = &stdLogger{s: s}
 
 	s.requestChan = make(chan *Request)
 	go s.handler()
@@ -66,26 +119,137 @@ func NewServer() *Server {
 	return s
 }
 
+// metricsSink returns s.Metrics, or a no-op sink if none is configured.
+func (s *Server) metricsSink() metrics.MetricsSink {
+	if s.Metrics == nil {
+		return metrics.Noop{}
+	}
+	return s.Metrics
+}
+
+// transportLabel reports the transport a request arrived over, for metrics labels. It
+// prefers request.transport, set explicitly by the listener that accepted the
+// connection (e.g. "tls" in tls.go), since deriving it from the frame type alone
+// cannot distinguish a TLS connection from plain TCP — both produce a *TCPFrame.
+// Listeners that haven't set request.transport fall back to that frame-type inference.
+func transportLabel(request *Request) string {
+	if request.transport != "" {
+		return request.transport
+	}
+	switch request.frame.(type) {
+	case *TCPFrame:
+		return "tcp"
+	default:
+		return "rtu"
+	}
+}
+
 // RegisterFunctionHandler override the default behavior for a given Modbus function.
+// It applies to unit 0, the default slave; use Slave(unitID).RegisterFunctionHandler
+// to override a function for a specific unit.
 func (s *Server) RegisterFunctionHandler(funcCode uint8, function func(*Server, Framer) ([]byte, *Exception)) {
 	s.function[funcCode] = function
+
+	s.memMu.RLock()
+	sl, ok := s.slaves[0]
+	s.memMu.RUnlock()
+	if ok {
+		sl.function[funcCode] = function
+	}
+}
+
+// Slave returns the memory maps and function-handler table for unitID, creating one
+// backed by its own empty memory maps on first use.
+func (s *Server) Slave(unitID uint8) *Slave {
+	s.memMu.Lock()
+	defer s.memMu.Unlock()
+
+	if s.slaves == nil {
+		s.slaves = make(map[uint8]*Slave)
+	}
+	sl, ok := s.slaves[unitID]
+	if !ok {
+		sl = newSlave(unitID)
+		s.slaves[unitID] = sl
+	}
+	return sl
 }
 
 func (s *Server) handle(request *Request) Framer {
 	var exception *Exception
 	var data []byte
 
-	log.Printf("function: %v, value: %+v\n", request.frame.GetFunction(), request.frame.GetData())
+	s.logger.Debugf("function: %v, value: %+v\n", request.frame.GetFunction(), request.frame.GetData())
+
+	start := time.Now()
+	function := request.frame.GetFunction()
+	transport := transportLabel(request)
+	unitID := request.frame.GetAddress()
+
+	s.metricsSink().IncRequest(function, unitID, transport)
+	defer func() {
+		s.metricsSink().ObserveLatency(function, transport, time.Since(start))
+		if exception != nil && exception != &Success {
+			s.metricsSink().IncException(uint8(*exception))
+		}
+	}()
 
 	response := request.frame.Copy()
 
-	function := request.frame.GetFunction()
-	if s.function[function] != nil {
+	if s.upstream != nil {
+		if proxied, proxyException := s.proxy(request, unitID); proxied != nil {
+			exception = proxyException
+			return proxied
+		}
+	}
+
+	s.memMu.RLock()
+	slave, ok := s.slaves[unitID]
+	s.memMu.RUnlock()
+	if !ok {
+		if transport != "rtu" {
+			exception = &GatewayTargetDeviceFailedToRespond
+			response.SetException(exception)
+			return response
+		}
+		// Unmatched RTU unit addresses are silently dropped per spec.
+		return nil
+	}
+
+	// Bind the active slave's memory maps and function table so the per-function
+	// handlers below, which operate on the Server's fields, see this unit's data for
+	// the duration of the request, then invoke the handler. Both the rebind and the
+	// invocation happen under memMu so a concurrent reader (e.g. persistence's
+	// snapshot goroutine) can never observe a half-rebound Server or one unit's data
+	// through fields it believes belong to another.
+	s.memMu.Lock()
+	s.DiscreteInputs = slave.DiscreteInputs
+	s.Coils = slave.Coils
+	s.HoldingRegisters = slave.HoldingRegisters
+	s.InputRegisters = slave.InputRegisters
+	s.function = slave.function
+
+	handlerFound := s.function[function] != nil
+	if handlerFound {
 		data, exception = s.function[function](s, request.frame)
-		response.SetData(data)
 	} else {
 		exception = &IllegalFunction
 	}
+	s.memMu.Unlock()
+
+	if handlerFound {
+		response.SetData(data)
+
+		s.persistMu.RLock()
+		persist := s.persist
+		s.persistMu.RUnlock()
+		if persist != nil && exception == &Success && persistedFunctions[function] {
+			address, quantity, payload := decodeWriteRequest(function, request.frame.GetData())
+			if err := persist.append(unitID, function, address, quantity, payload); err != nil {
+				s.logger.Errorf("mbserver: WAL append failed: %v", err)
+			}
+		}
+	}
 
 	if exception != &Success {
 		response.SetException(exception)
@@ -99,7 +263,16 @@ func (s *Server) handler() {
 	for {
 		request := <-s.requestChan
 		response := s.handle(request)
-		request.conn.Write(response.Bytes())
+		if response == nil {
+			continue
+		}
+		respBytes := response.Bytes()
+		n, err := request.conn.Write(respBytes)
+		if err != nil {
+			s.logger.Errorf("mbserver: write response failed: %v", err)
+			continue
+		}
+		s.metricsSink().AddBytesWritten(transportLabel(request), n)
 	}
 }
 
@@ -112,56 +285,3 @@ func (s *Server) Close() {
 		port.Close()
 	}
 }
-
-type StateObject struct {
-	DiscreteInputs   []byte
-	Coils            []byte
-	HoldingRegisters []uint16
-	InputRegisters   []uint16
-}
-
-func (s *Server) saveState() {
-	log.Println("saving state . . .")
-	defer log.Println("done")
-
-	so := StateObject{
-		DiscreteInputs:   s.DiscreteInputs,
-		Coils:            s.Coils,
-		HoldingRegisters: s.HoldingRegisters,
-		InputRegisters:   s.InputRegisters,
-	}
-
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(so)
-	if err != nil {
-		log.Fatal(err)
-	}
-	err = ioutil.WriteFile(checkpointFile, buf.Bytes(), 0644)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
-func (s *Server) restoreState() {
-	log.Println("restoring state . . .")
-	defer log.Println("done")
-
-	if _, err := os.Stat(checkpointFile); !os.IsNotExist(err) {
-		f, err := os.Open(checkpointFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		var so StateObject
-		dec := gob.NewDecoder(f)
-		err = dec.Decode(&so)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		s.DiscreteInputs = so.DiscreteInputs
-		s.Coils = so.Coils
-		s.HoldingRegisters = so.HoldingRegisters
-		s.InputRegisters = so.InputRegisters
-	}
-}
@@ -0,0 +1,38 @@
+package mbserver
+
+import "testing"
+
+// fakeFrame is a minimal Framer used across this package's tests to drive handle()
+// and transportLabel directly, without depending on the real TCP/RTU frame
+// implementations.
+type fakeFrame struct {
+	unitID   uint8
+	function uint8
+	data     []byte
+
+	setData      []byte
+	setException *Exception
+}
+
+func (f *fakeFrame) GetFunction() uint8 { return f.function }
+func (f *fakeFrame) GetAddress() uint8  { return f.unitID }
+func (f *fakeFrame) GetData() []byte    { return f.data }
+func (f *fakeFrame) Copy() Framer {
+	cp := *f
+	return &cp
+}
+func (f *fakeFrame) SetData(data []byte)       { f.setData = data }
+func (f *fakeFrame) SetException(e *Exception) { f.setException = e }
+func (f *fakeFrame) Bytes() []byte             { return f.setData }
+
+func TestTransportLabelPrefersRequestTransport(t *testing.T) {
+	tlsRequest := &Request{transport: "tls", frame: &fakeFrame{}}
+	if got := transportLabel(tlsRequest); got != "tls" {
+		t.Fatalf("expected explicit request.transport %q to win over frame-type inference, got %q", "tls", got)
+	}
+
+	inferred := &Request{frame: &fakeFrame{}}
+	if got := transportLabel(inferred); got != "rtu" {
+		t.Fatalf("expected a request with no transport set to fall back to frame-type inference, got %q", got)
+	}
+}
@@ -0,0 +1,39 @@
+package mbserver
+
+// Slave is one Modbus slave (unit) served by a Server: its own discrete and register
+// memory maps plus its own function-handler table, keyed by unit ID in Server.slaves.
+type Slave struct {
+	unitID           uint8
+	DiscreteInputs   []byte
+	Coils            []byte
+	HoldingRegisters []uint16
+	InputRegisters   []uint16
+	function         [256](func(*Server, Framer) ([]byte, *Exception))
+}
+
+// newSlave allocates unitID's memory maps and installs the default function handlers.
+func newSlave(unitID uint8) *Slave {
+	sl := &Slave{unitID: unitID}
+
+	sl.DiscreteInputs = make([]byte, 65536)
+	sl.Coils = make([]byte, 65536)
+	sl.HoldingRegisters = make([]uint16, 65536)
+	sl.InputRegisters = make([]uint16, 65536)
+
+	sl.function[1] = ReadCoils
+	sl.function[2] = ReadDiscreteInputs
+	sl.function[3] = ReadHoldingRegisters
+	sl.function[4] = ReadInputRegisters
+	sl.function[5] = WriteSingleCoil
+	sl.function[6] = WriteHoldingRegister
+	sl.function[15] = WriteMultipleCoils
+	sl.function[16] = WriteHoldingRegisters
+
+	return sl
+}
+
+// RegisterFunctionHandler overrides the default behavior for a given Modbus function
+// on this slave only.
+func (sl *Slave) RegisterFunctionHandler(funcCode uint8, function func(*Server, Framer) ([]byte, *Exception)) {
+	sl.function[funcCode] = function
+}
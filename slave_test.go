@@ -0,0 +1,84 @@
+package mbserver
+
+import "testing"
+
+func TestServerSlaveCreatesAndReuses(t *testing.T) {
+	s := NewServer()
+
+	sl := s.Slave(1)
+	if len(sl.Coils) != 65536 {
+		t.Fatalf("expected a freshly allocated Coils map, got len %d", len(sl.Coils))
+	}
+
+	if again := s.Slave(1); again != sl {
+		t.Fatal("expected a second Slave(1) call to return the same *Slave")
+	}
+
+	if s.Slave(0) != s.slaves[0] {
+		t.Fatal("expected Slave(0) to return the default slave backing the Server's own fields")
+	}
+}
+
+func TestSlaveRegisterFunctionHandlerIsPerSlave(t *testing.T) {
+	s := NewServer()
+	sl := s.Slave(1)
+
+	called := false
+	sl.RegisterFunctionHandler(99, func(srv *Server, fr Framer) ([]byte, *Exception) {
+		called = true
+		return []byte{1}, &Success
+	})
+
+	if sl.function[99] == nil {
+		t.Fatal("expected RegisterFunctionHandler to install the handler on this slave")
+	}
+	if s.function[99] != nil {
+		t.Fatal("expected a Slave's RegisterFunctionHandler to leave the Server's own table untouched")
+	}
+
+	s.handle(&Request{transport: "tcp", frame: &fakeFrame{unitID: 1, function: 99}})
+	if !called {
+		t.Fatal("expected the per-slave handler to run for a request routed to unit 1")
+	}
+}
+
+func TestHandleRoutesByUnitID(t *testing.T) {
+	s := NewServer()
+	s.Slave(1).RegisterFunctionHandler(99, func(srv *Server, fr Framer) ([]byte, *Exception) {
+		return []byte{0x2A}, &Success
+	})
+
+	resp := s.handle(&Request{transport: "tcp", frame: &fakeFrame{unitID: 1, function: 99}})
+	ff, ok := resp.(*fakeFrame)
+	if !ok {
+		t.Fatalf("expected *fakeFrame response, got %T", resp)
+	}
+	if ff.setException != nil && *ff.setException != Success {
+		t.Fatalf("expected no exception, got %v", *ff.setException)
+	}
+	if len(ff.setData) != 1 || ff.setData[0] != 0x2A {
+		t.Fatalf("expected the response routed to unit 1's handler, got %x", ff.setData)
+	}
+}
+
+func TestHandleUnknownUnitTCPReturnsGatewayException(t *testing.T) {
+	s := NewServer()
+
+	resp := s.handle(&Request{transport: "tcp", frame: &fakeFrame{unitID: 99, function: 3}})
+	ff, ok := resp.(*fakeFrame)
+	if !ok {
+		t.Fatalf("expected *fakeFrame response, got %T", resp)
+	}
+	if ff.setException == nil || *ff.setException != GatewayTargetDeviceFailedToRespond {
+		t.Fatalf("expected GatewayTargetDeviceFailedToRespond for an unmatched TCP unit, got %v", ff.setException)
+	}
+}
+
+func TestHandleUnknownUnitRTUIsDroppedSilently(t *testing.T) {
+	s := NewServer()
+
+	resp := s.handle(&Request{transport: "rtu", frame: &fakeFrame{unitID: 99, function: 3}})
+	if resp != nil {
+		t.Fatalf("expected no response for an unmatched RTU unit per spec, got %v", resp)
+	}
+}
@@ -0,0 +1,140 @@
+package mbserver
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestRoleAllowsAddressRejectsOverflowingQuantity(t *testing.T) {
+	role := Role{Addresses: []AddressRange{{Start: 0, End: 5}}}
+
+	if !role.allowsAddress(0, 3) {
+		t.Fatal("expected address 0, quantity 3 to be allowed")
+	}
+
+	// address=6, quantity=65531 would wrap address+quantity-1 back to 0 in uint16
+	// arithmetic, which is <= 5 and would be wrongly allowed.
+	if role.allowsAddress(6, 65531) {
+		t.Fatal("expected out-of-range address span to be rejected, not allowed via overflow")
+	}
+}
+
+func TestRoleAllowsFunctionPermissionMask(t *testing.T) {
+	readOnly := Role{Permission: PermRead}
+	if !readOnly.allowsFunction(0, 3) {
+		t.Fatal("expected PermRead to allow function 3 (read holding registers)")
+	}
+	if readOnly.allowsFunction(0, 6) {
+		t.Fatal("expected PermRead to reject function 6 (write holding register)")
+	}
+
+	readWrite := Role{Permission: PermRead | PermWrite}
+	if !readWrite.allowsFunction(0, 6) {
+		t.Fatal("expected PermWrite to allow function 6")
+	}
+}
+
+func TestRoleAllowsFunctionCustomFunctionsMaskOverridesPermission(t *testing.T) {
+	role := Role{Permission: PermRead | PermWrite, Functions: map[uint8]bool{3: true}}
+
+	if !role.allowsFunction(0, 3) {
+		t.Fatal("expected the explicit Functions mask to allow function 3")
+	}
+	if role.allowsFunction(0, 6) {
+		t.Fatal("expected Functions to override Permission, rejecting function 6 though PermWrite would otherwise allow it")
+	}
+}
+
+func TestRoleAllowsFunctionUnitsScoping(t *testing.T) {
+	role := Role{Permission: PermRead, Units: []uint8{1, 2}}
+
+	if !role.allowsFunction(1, 3) {
+		t.Fatal("expected unit 1 to be allowed, it's in Units")
+	}
+	if role.allowsFunction(5, 3) {
+		t.Fatal("expected unit 5 to be rejected, it isn't in Units")
+	}
+}
+
+func TestRoleMapRoleFor(t *testing.T) {
+	value, err := asn1.Marshal("operator")
+	if err != nil {
+		t.Fatalf("asn1.Marshal: %v", err)
+	}
+
+	roles := RoleMap{Roles: map[string]Role{"operator": {Permission: PermRead}}}
+
+	cert := &x509.Certificate{Extensions: []pkix.Extension{{Id: defaultRoleOID, Value: value}}}
+	role, ok := roles.roleFor(cert)
+	if !ok {
+		t.Fatal("expected the role extension to resolve to a known role")
+	}
+	if role.Permission != PermRead {
+		t.Fatalf("expected the operator role, got %+v", role)
+	}
+
+	unknownValue, _ := asn1.Marshal("nonexistent")
+	unknownCert := &x509.Certificate{Extensions: []pkix.Extension{{Id: defaultRoleOID, Value: unknownValue}}}
+	if _, ok := roles.roleFor(unknownCert); ok {
+		t.Fatal("expected an unmapped role name to fail lookup")
+	}
+
+	noExtCert := &x509.Certificate{}
+	if _, ok := roles.roleFor(noExtCert); ok {
+		t.Fatal("expected a certificate with no matching extension to fail lookup")
+	}
+}
+
+func TestServerAuthorize(t *testing.T) {
+	s := &Server{}
+	role := Role{Permission: PermRead, Addresses: []AddressRange{{Start: 0, End: 9}}}
+
+	tests := []struct {
+		name          string
+		function      uint8
+		data          []byte
+		wantException *Exception
+	}{
+		{
+			name:     "allowed read within range",
+			function: 3,
+			data:     []byte{0x00, 0x00, 0x00, 0x02}, // address 0, quantity 2
+		},
+		{
+			name:          "illegal function",
+			function:      6, // write, not permitted by a read-only role
+			data:          []byte{0x00, 0x00, 0x00, 0x01},
+			wantException: &IllegalFunction,
+		},
+		{
+			name:          "illegal address range",
+			function:      3,
+			data:          []byte{0x00, 0x0A, 0x00, 0x02}, // address 10, quantity 2: outside 0-9
+			wantException: &IllegalDataAddress,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := &fakeFrame{function: tt.function, data: tt.data}
+			resp := s.authorize(frame, role)
+
+			if tt.wantException == nil {
+				if resp != nil {
+					t.Fatalf("expected the request to pass through to normal dispatch (nil response), got %v", resp)
+				}
+				return
+			}
+
+			ff, ok := resp.(*fakeFrame)
+			if !ok {
+				t.Fatalf("expected *fakeFrame response, got %T", resp)
+			}
+			if ff.setException == nil || *ff.setException != *tt.wantException {
+				t.Fatalf("expected exception %v, got %v", *tt.wantException, ff.setException)
+			}
+		})
+	}
+}